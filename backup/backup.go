@@ -0,0 +1,363 @@
+// Package backup walks a Gmail mailbox and writes every message to local
+// mbox or Maildir storage, keeping enough state on disk to resume an
+// interrupted run and to fetch only new messages on subsequent runs.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Format selects the on-disk layout messages are written to.
+type Format string
+
+const (
+	// FormatMbox appends every message to a single Unix mbox file.
+	FormatMbox Format = "mbox"
+	// FormatMaildir writes one file per message into a Maildir tree.
+	FormatMaildir Format = "maildir"
+)
+
+// Options configures a backup run.
+type Options struct {
+	// OutputDir is where the mbox file or Maildir tree is created.
+	OutputDir string
+	// Format selects mbox or Maildir output. Defaults to FormatMbox.
+	Format Format
+	// StateFile is the path to the JSON file tracking downloaded message
+	// IDs and the last-seen historyId. Defaults to "state.json" inside
+	// OutputDir.
+	StateFile string
+	// Query is a Gmail search query, equivalent to the `q` parameter
+	// accepted by Users.Messages.List. It applies to the full listing
+	// only: an incremental run via Users.History.List fetches every
+	// message added since the last historyId, whether or not it matches.
+	Query string
+	// LabelIDs restricts the backup to messages carrying all of these
+	// labels.
+	LabelIDs []string
+	// Workers is the number of concurrent Messages.Get fetches. Defaults
+	// to 4.
+	Workers int
+	// RateLimit caps the number of Gmail API requests issued per second
+	// across all workers, to stay under the per-user quota. Defaults to
+	// 10 requests/second.
+	RateLimit float64
+}
+
+func (o Options) withDefaults() Options {
+	if o.Format == "" {
+		o.Format = FormatMbox
+	}
+	if o.StateFile == "" {
+		o.StateFile = filepathJoin(o.OutputDir, "state.json")
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.RateLimit <= 0 {
+		o.RateLimit = 10
+	}
+	return o
+}
+
+// Backup fetches every message in the user's mailbox matching opts and
+// writes it to local storage. On the first run it performs a full listing
+// via Users.Messages.List, paging through PageToken until exhausted. On
+// subsequent runs, if the state file already has a historyId, it instead
+// fetches only the changes since that point via Users.History.List.
+func Backup(ctx context.Context, srv *gmail.Service, user string, opts Options) error {
+	opts = opts.withDefaults()
+
+	state, err := loadState(opts.StateFile)
+	if err != nil {
+		return fmt.Errorf("loading backup state: %w", err)
+	}
+
+	writer, err := newWriter(opts.Format, opts.OutputDir)
+	if err != nil {
+		return fmt.Errorf("opening output: %w", err)
+	}
+	defer writer.Close()
+
+	var ids []string
+	if state.HistoryID != 0 {
+		ids, err = deltaMessageIDs(ctx, srv, user, opts, state)
+		if err != nil {
+			return fmt.Errorf("listing history delta: %w", err)
+		}
+	} else {
+		ids, err = listAllMessageIDs(ctx, srv, user, opts)
+		if err != nil {
+			return fmt.Errorf("listing messages: %w", err)
+		}
+	}
+
+	// Skip IDs we've already saved, so an interrupted run can resume
+	// without re-downloading.
+	pending := ids[:0]
+	for _, id := range ids {
+		if _, ok := state.Messages[id]; !ok {
+			pending = append(pending, id)
+		}
+	}
+
+	if err := fetchAndStore(ctx, srv, user, pending, opts, writer, state); err != nil {
+		return err
+	}
+
+	profile, err := srv.Users.GetProfile(user).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("fetching profile history id: %w", err)
+	}
+	state.HistoryID = profile.HistoryId
+
+	if err := saveState(opts.StateFile, state); err != nil {
+		return fmt.Errorf("saving backup state: %w", err)
+	}
+	return nil
+}
+
+// listAllMessageIDs pages through Users.Messages.List until PageToken is
+// exhausted, applying opts.Query and opts.LabelIDs as filters.
+func listAllMessageIDs(ctx context.Context, srv *gmail.Service, user string, opts Options) ([]string, error) {
+	var ids []string
+	pageToken := ""
+	for {
+		call := srv.Users.Messages.List(user).Context(ctx)
+		if opts.Query != "" {
+			call = call.Q(opts.Query)
+		}
+		if len(opts.LabelIDs) > 0 {
+			call = call.LabelIds(opts.LabelIDs...)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range resp.Messages {
+			ids = append(ids, m.Id)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return ids, nil
+}
+
+// deltaMessageIDs enumerates message IDs added since state.HistoryID via
+// Users.History.List, keeping those that carry all of opts.LabelIDs
+// (opts.Query is not applied). If the history ID has expired (Gmail only retains
+// ~7 days of history), it falls back to a full re-list.
+func deltaMessageIDs(ctx context.Context, srv *gmail.Service, user string, opts Options, state *State) ([]string, error) {
+	var ids []string
+	pageToken := ""
+	for {
+		call := srv.Users.History.List(user).
+			StartHistoryId(state.HistoryID).
+			HistoryTypes("messageAdded").
+			Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Do()
+		if err != nil {
+			if isHistoryExpired(err) {
+				return listAllMessageIDs(ctx, srv, user, opts)
+			}
+			return nil, err
+		}
+		for _, h := range resp.History {
+			for _, a := range h.MessagesAdded {
+				matched := 0
+				for _, want := range opts.LabelIDs {
+					for _, got := range a.Message.LabelIds {
+						if got == want {
+							matched++
+							break
+						}
+					}
+				}
+				if matched == len(opts.LabelIDs) {
+					ids = append(ids, a.Message.Id)
+				}
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return ids, nil
+}
+
+// isHistoryExpired reports whether err is the 404 Gmail returns once
+// state.HistoryID has aged out of its ~7-day retention window.
+func isHistoryExpired(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404")
+}
+
+// fetchAndStore downloads each message in ids using a bounded worker pool
+// and a global rate limiter, writing the raw RFC 5322 bytes to writer and
+// recording the resulting path in state. State is persisted after every 50
+// stored messages, so a crash mid-run loses at most the last 49 messages
+// worth of progress.
+func fetchAndStore(ctx context.Context, srv *gmail.Service, user string, ids []string, opts Options, writer messageWriter, state *State) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	limiter := newRateLimiter(opts.RateLimit)
+	jobs := make(chan string)
+	results := make(chan fetchResult)
+	var wg sync.WaitGroup
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				limiter.wait()
+				msg, err := srv.Users.Messages.Get(user, id).Format("raw").Context(ctx).Do()
+				if err != nil {
+					results <- fetchResult{id: id, err: fmt.Errorf("fetching message %s: %w", id, err)}
+					continue
+				}
+				results <- fetchResult{id: id, message: msg}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	go func() {
+		defer close(jobs)
+		for _, id := range ids {
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var firstErr error
+	count := 0
+	for res := range results {
+		if res.err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			mu.Unlock()
+			continue
+		}
+
+		raw, err := decodeRaw(res.message.Raw)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("decoding message %s: %w", res.id, err)
+			}
+			mu.Unlock()
+			continue
+		}
+
+		path, err := writer.Write(res.id, raw)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("writing message %s: %w", res.id, err)
+			}
+			mu.Unlock()
+			continue
+		}
+
+		mu.Lock()
+		state.Messages[res.id] = path
+		count++
+		if count%50 == 0 {
+			_ = saveState(opts.StateFile, state)
+		}
+		mu.Unlock()
+	}
+
+	if firstErr != nil {
+		if err := saveState(opts.StateFile, state); err != nil {
+			return fmt.Errorf("%w (also failed to save state: %v)", firstErr, err)
+		}
+		return firstErr
+	}
+	return saveState(opts.StateFile, state)
+}
+
+type fetchResult struct {
+	id      string
+	message *gmail.Message
+	err     error
+}
+
+// rateLimiter is a simple token bucket that releases one token every
+// 1/rps, used to keep concurrent workers under Gmail's per-user quota.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / rps))}
+}
+
+func (r *rateLimiter) wait() {
+	<-r.ticker.C
+}
+
+// State is the persisted record of a backup run: which Gmail message IDs
+// have already been downloaded and where, plus the historyId to resume
+// from on the next run.
+type State struct {
+	Messages  map[string]string `json:"messages"`
+	HistoryID uint64            `json:"historyId"`
+}
+
+func loadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{Messages: make(map[string]string)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Messages == nil {
+		state.Messages = make(map[string]string)
+	}
+	return state, nil
+}
+
+func saveState(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
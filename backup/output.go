@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// messageWriter persists a single message's raw RFC 5322 bytes and
+// returns the local path it was written to.
+type messageWriter interface {
+	Write(id string, raw []byte) (string, error)
+	Close() error
+}
+
+func newWriter(format Format, outputDir string) (messageWriter, error) {
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatMaildir:
+		return newMaildirWriter(outputDir)
+	case FormatMbox, "":
+		return newMboxWriter(outputDir)
+	default:
+		return nil, fmt.Errorf("unknown backup format %q", format)
+	}
+}
+
+func filepathJoin(dir, name string) string {
+	return filepath.Join(dir, name)
+}
+
+// decodeRaw decodes the base64url-encoded Raw field returned when a
+// message is fetched with Format("raw").
+func decodeRaw(raw string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(raw)
+}
+
+// mboxWriter appends messages to a single Unix mbox file, escaping any
+// line that begins with "From " in the message body so it isn't mistaken
+// for a message boundary.
+type mboxWriter struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func newMboxWriter(outputDir string) (*mboxWriter, error) {
+	path := filepath.Join(outputDir, "mailbox.mbox")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &mboxWriter{path: path, f: f}, nil
+}
+
+func (w *mboxWriter) Write(id string, raw []byte) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w.f, "From backup@gmail %s\n", time.Now().UTC().Format(time.ANSIC)); err != nil {
+		return "", err
+	}
+	if _, err := w.f.Write(escapeFromLines(raw)); err != nil {
+		return "", err
+	}
+	if _, err := w.f.Write([]byte("\n\n")); err != nil {
+		return "", err
+	}
+	return w.path, nil
+}
+
+func (w *mboxWriter) Close() error {
+	return w.f.Close()
+}
+
+// escapeFromLines prefixes any line starting with "From ", or with one or
+// more ">" followed by "From ", with another ">", the standard mboxrd
+// convention for preventing it from being parsed as a message boundary.
+func escapeFromLines(raw []byte) []byte {
+	lines := bytes.Split(raw, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			lines[i] = append([]byte(">"), line...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// maildirWriter writes one file per message into a Maildir tree, creating
+// the standard cur/new/tmp subdirectories and delivering each message
+// directly into new/ with a unique filename.
+type maildirWriter struct {
+	mu      sync.Mutex
+	newDir  string
+	counter int
+}
+
+func newMaildirWriter(outputDir string) (*maildirWriter, error) {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(outputDir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &maildirWriter{newDir: filepath.Join(outputDir, "new")}, nil
+}
+
+func (w *maildirWriter) Write(id string, raw []byte) (string, error) {
+	w.mu.Lock()
+	w.counter++
+	name := fmt.Sprintf("%d.%d.%s.%s", time.Now().UnixNano(), os.Getpid(), strconv.Itoa(w.counter), id)
+	w.mu.Unlock()
+
+	path := filepath.Join(w.newDir, name)
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (w *maildirWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+// Package compose builds RFC 2822 email messages, including file
+// attachments, and encodes them into the base64url Raw format the Gmail
+// API expects for both Users.Messages.Send and Users.Drafts.Create.
+package compose
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Options describes the message to compose.
+type Options struct {
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	Body        string
+	Attachments []string // local file paths to attach
+}
+
+// Build assembles opts into a *gmail.Message whose Raw field holds the
+// base64url-encoded RFC 2822 message, ready to pass to
+// srv.Users.Messages.Send or srv.Users.Drafts.Create.
+func Build(opts Options) (*gmail.Message, error) {
+	raw, err := buildRaw(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.Message{Raw: encodeRaw(raw)}, nil
+}
+
+func buildRaw(opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("To", joinAddresses(opts.To))
+	if len(opts.Cc) > 0 {
+		header.Set("Cc", joinAddresses(opts.Cc))
+	}
+	if len(opts.Bcc) > 0 {
+		header.Set("Bcc", joinAddresses(opts.Bcc))
+	}
+	header.Set("Subject", opts.Subject)
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", writer.Boundary()))
+	writeHeader(&buf, header)
+
+	bodyHeader := make(textproto.MIMEHeader)
+	bodyHeader.Set("Content-Type", "text/plain; charset=UTF-8")
+	bodyHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+	bodyPart, err := writer.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, fmt.Errorf("creating body part: %w", err)
+	}
+	qp := quotedprintable.NewWriter(bodyPart)
+	if _, err := qp.Write([]byte(opts.Body)); err != nil {
+		return nil, fmt.Errorf("writing body: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, fmt.Errorf("flushing body: %w", err)
+	}
+
+	for _, path := range opts.Attachments {
+		if err := attachFile(writer, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("closing multipart writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// attachFile reads path and appends it to writer as a base64-encoded
+// attachment part, auto-detecting its content type from the file's
+// contents when it can't be inferred from the file extension.
+func attachFile(writer *multipart.Writer, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading attachment %s: %w", path, err)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	filename := filepath.Base(path)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("creating attachment part for %s: %w", path, err)
+	}
+
+	if _, err := part.Write([]byte(base64.StdEncoding.EncodeToString(data))); err != nil {
+		return fmt.Errorf("writing attachment %s: %w", path, err)
+	}
+	return nil
+}
+
+// encodeRaw base64url-encodes a full RFC 2822 message for the Gmail API's
+// Message.Raw field.
+func encodeRaw(raw []byte) string {
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for k, values := range header {
+		for _, v := range values {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func joinAddresses(addrs []string) string {
+	out := ""
+	for i, a := range addrs {
+		if i > 0 {
+			out += ", "
+		}
+		out += a
+	}
+	return out
+}
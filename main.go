@@ -1,41 +1,145 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
+
+	"github.com/nkumar15/gmail-backup/backup"
+	"github.com/nkumar15/gmail-backup/compose"
+	"github.com/nkumar15/gmail-backup/tokenstore"
 )
 
-// getClient uses a Context and Config to retrieve a Token
+// getClient uses a Context, Config, and TokenStore to retrieve a Token
 // then generate a Client. It returns the generated Client.
-func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	cacheFile, err := tokenCacheFile()
-	if err != nil {
-		log.Fatalf("Unable to get path to cached credential file. %v", err)
-	}
-	tok, err := tokenFromFile(cacheFile)
+//
+// account identifies which cached token to load; pass "" on first use and
+// getClient will resolve the real account email after the web auth flow
+// (from the ID token, falling back to Users.GetProfile) and store the
+// token under that key.
+func getClient(ctx context.Context, config *oauth2.Config, store tokenstore.Store, account string) *http.Client {
+	key := tokenKey(account, config.Scopes)
+
+	// Any failure to load a usable token - not just a missing file -
+	// falls back to re-authenticating, same as the original
+	// tokenFromFile/getTokenFromWeb fallback. This also self-heals a
+	// corrupted cache file instead of requiring the user to delete it by
+	// hand.
+	tok, err := store.Get(key)
 	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Cached token unusable, re-authenticating: %v", err)
+		}
+
 		tok = getTokenFromWeb(config)
-		saveToken(cacheFile, tok)
+		if resolved := resolveAccountEmail(ctx, config, tok); resolved != "" {
+			if account != "" && resolved != account {
+				log.Fatalf("Authenticated as %s, but -account=%s was requested; check which Google account your browser is signed into.", resolved, account)
+			}
+			account = resolved
+			key = tokenKey(account, config.Scopes)
+		}
+
+		if err := store.Put(key, tok); err != nil {
+			log.Fatalf("Unable to cache oauth token: %v", err)
+		}
+		if account != "" {
+			fmt.Printf("Authenticated as %s; pass -account=%s next time to reuse this token directly.\n", account, account)
+		}
 	}
 	return config.Client(ctx, tok)
 }
 
-// getTokenFromWeb uses Config to request a Token.
+// tokenKey derives the TokenStore key for an account and scope set: the
+// account name (or "default" until resolved) plus a hash of the scopes,
+// so requesting a broader scope never reuses a token cached under a
+// narrower one.
+func tokenKey(account string, scopes []string) string {
+	if account == "" {
+		account = "default"
+	}
+	return account + "-" + scopeHash(scopes)
+}
+
+// resolveAccountEmail extracts the Gmail address the token belongs to,
+// first from the ID token's email claim (present when the "openid" and
+// "email" scopes were granted) and, failing that, via Users.GetProfile.
+// It returns "" if neither source is available.
+func resolveAccountEmail(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) string {
+	if email := emailFromIDToken(tok); email != "" {
+		return email
+	}
+
+	srv, err := gmail.New(config.Client(ctx, tok))
+	if err != nil {
+		return ""
+	}
+	profile, err := srv.Users.GetProfile("me").Context(ctx).Do()
+	if err != nil {
+		return ""
+	}
+	return profile.EmailAddress
+}
+
+// emailFromIDToken pulls the "email" claim out of the unverified payload
+// of the token's ID token, if one was issued.
+func emailFromIDToken(tok *oauth2.Token) string {
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return ""
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Email
+}
+
+// getTokenFromWeb uses Config to request a Token. If the client secret
+// declares a loopback redirect URI (http://localhost[:port]), it spins up
+// a local server to capture the authorization code automatically. Otherwise
+// it falls back to the manual copy-paste flow.
 // It returns the retrieved Token.
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	if isLoopbackRedirect(config.RedirectURL) {
+		tok, err := getTokenFromLoopback(config)
+		if err != nil {
+			log.Fatalf("Unable to retrieve token via loopback flow: %v", err)
+		}
+		return tok
+	}
+
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
@@ -52,59 +156,184 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	return tok
 }
 
-// tokenCacheFile generates credential file path/filename.
-// It returns the generated credential path/filename.
-func tokenCacheFile() (string, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", err
+// isLoopbackRedirect reports whether redirectURL is a localhost HTTP
+// redirect, as opposed to the legacy out-of-band "urn:ietf:wg:oauth:2.0:oob"
+// value or an external HTTPS redirect.
+func isLoopbackRedirect(redirectURL string) bool {
+	u, err := url.Parse(redirectURL)
+	if err != nil || u.Scheme != "http" {
+		return false
 	}
-	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials")
-	os.MkdirAll(tokenCacheDir, 0700)
-	return filepath.Join(tokenCacheDir,
-		url.QueryEscape("gmail-go-quickstart.json")), err
+	host := u.Hostname()
+	return host == "localhost" || host == "127.0.0.1"
 }
 
-// tokenFromFile retrieves a Token from a given file path.
-// It returns the retrieved Token and any read error encountered.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+// getTokenFromLoopback prints the authorization URL for the user to open in
+// their browser and listens on the redirect URI's address for the OAuth
+// callback, validating the state parameter before exchanging the returned
+// code for a token. It does not launch a browser itself.
+func getTokenFromLoopback(config *oauth2.Config) (*oauth2.Token, error) {
+	redirect, err := url.Parse(config.RedirectURL)
 	if err != nil {
+		return nil, fmt.Errorf("parsing redirect URL: %w", err)
+	}
+
+	listenAddr := redirect.Host
+	if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+		// No explicit port (e.g. "http://localhost"): bind an ephemeral
+		// port, per Google's dynamic-port loopback guidance for installed
+		// apps, and use whatever the OS actually hands us.
+		listenAddr = net.JoinHostPort(redirect.Hostname(), "0")
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", listenAddr, err)
+	}
+
+	// The actual bound port may differ from what was requested (":0", or
+	// none at all); rebuild the redirect URI from it so AuthCodeURL and
+	// the token exchange both send the address we're really listening on.
+	redirect.Host = listener.Addr().String()
+	loopbackConfig := *config
+	loopbackConfig.RedirectURL = redirect.String()
+	config = &loopbackConfig
+
+	state, err := randomState()
+	if err != nil {
+		return nil, fmt.Errorf("generating state token: %w", err)
+	}
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "state parameter mismatch", http.StatusBadRequest)
+			errCh <- fmt.Errorf("state parameter mismatch")
+			return
+		}
+		if errMsg := q.Get("error"); errMsg != "" {
+			http.Error(w, errMsg, http.StatusBadRequest)
+			errCh <- fmt.Errorf("authorization denied: %s", errMsg)
+			return
+		}
+		code := q.Get("code")
+		if code == "" {
+			http.Error(w, "missing code parameter", http.StatusBadRequest)
+			errCh <- fmt.Errorf("missing code parameter")
+			return
+		}
+		fmt.Fprint(w, "<html><body>Authorization succeeded, you may close this tab and return to the terminal.</body></html>")
+		codeCh <- code
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser:\n%v\n", authURL)
+
+	var code string
+	select {
+	case code = <-codeCh:
+	case err := <-errCh:
 		return nil, err
 	}
-	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
+
+	tok, err := config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving token from web: %w", err)
+	}
+	return tok, nil
 }
 
-// saveToken uses a file path to create a file and store the
-// token in it.
-func saveToken(file string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// randomState generates a URL-safe random string suitable for use as the
+// OAuth2 state parameter, to guard the loopback callback against CSRF.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// scopeHash returns a short, order-independent hash identifying a set of
+// OAuth scopes, used to key the token cache per scope set.
+func scopeHash(scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return fmt.Sprintf("%x", sum)[:12]
+}
+
+// newTokenStore builds the TokenStore selected by -token-store, rooted at
+// ~/.credentials as the original single-file cache was.
+func newTokenStore(kind, passphrase string) (tokenstore.Store, error) {
+	usr, err := user.Current()
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return nil, err
+	}
+	dir := filepath.Join(usr.HomeDir, ".credentials")
+
+	switch kind {
+	case "", "file":
+		return tokenstore.NewFileStore(dir)
+	case "encrypted":
+		if passphrase == "" {
+			return nil, fmt.Errorf("-passphrase is required for -token-store=encrypted")
+		}
+		return tokenstore.NewEncryptedFileStore(dir, passphrase)
+	case "keyring":
+		return tokenstore.NewKeyringStore("gmail-backup"), nil
+	default:
+		return nil, fmt.Errorf("unknown -token-store %q", kind)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
 }
 
 func main() {
 	ctx := context.Background()
 
+	globalFS := flag.NewFlagSet("gmail-backup", flag.ExitOnError)
+	account := globalFS.String("account", "", "Gmail account email whose cached token to use (omit on first run; it will be detected and printed)")
+	tokenStoreKind := globalFS.String("token-store", "file", "where to persist OAuth tokens: file, encrypted, or keyring")
+	passphrase := globalFS.String("passphrase", "", "passphrase to derive the encryption key for -token-store=encrypted")
+	globalFS.Parse(os.Args[1:])
+
+	args := globalFS.Args()
+	var cmd string
+	if len(args) > 0 {
+		cmd = args[0]
+		args = args[1:]
+	}
+
 	b, err := ioutil.ReadFile("client_secret.json")
 	if err != nil {
 		log.Fatalf("Unable to read client secret file: %v", err)
 	}
 
-	// If modifying these scopes, delete your previously saved credentials
-	// at ~/.credentials/gmail-go-quickstart.json
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	// The scopes requested depend on the subcommand: sending mail needs
+	// broader access than the default readonly demo. getClient folds
+	// config.Scopes into the token store key, so switching commands
+	// transparently picks up a fresh token with the right scope instead
+	// of reusing one cached under a narrower grant.
+	config, err := google.ConfigFromJSON(b, scopesForCommand(cmd)...)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
-	client := getClient(ctx, config)
+
+	store, err := newTokenStore(*tokenStoreKind, *passphrase)
+	if err != nil {
+		log.Fatalf("Unable to set up token store: %v", err)
+	}
+
+	client := getClient(ctx, config, store, *account)
 
 	srv, err := gmail.New(client)
 	if err != nil {
@@ -112,7 +341,123 @@ func main() {
 	}
 
 	user := "me"
-	listMessages(srv, user)
+
+	switch cmd {
+	case "backup":
+		runBackup(ctx, srv, user, args)
+	case "send":
+		runSend(ctx, srv, user, args)
+	default:
+		listMessages(srv, user)
+	}
+}
+
+// scopesForCommand returns the OAuth scopes required by the given
+// subcommand. Unrecognized or empty commands get the original readonly
+// demo scope.
+func scopesForCommand(cmd string) []string {
+	switch cmd {
+	case "send":
+		return []string{gmail.GmailSendScope, gmail.GmailComposeScope}
+	default:
+		return []string{gmail.GmailReadonlyScope}
+	}
+}
+
+// runSend parses the `send` subcommand's flags, builds an RFC 2822
+// message via the compose package, and either sends it immediately or
+// stores it as a draft.
+func runSend(ctx context.Context, srv *gmail.Service, user string, args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	to := fs.String("to", "", "comma-separated list of recipients")
+	cc := fs.String("cc", "", "comma-separated list of cc recipients")
+	bcc := fs.String("bcc", "", "comma-separated list of bcc recipients")
+	subject := fs.String("subject", "", "message subject")
+	body := fs.String("body", "", "message body")
+	draft := fs.Bool("draft", false, "store as a draft instead of sending")
+	var attachments stringSliceFlag
+	fs.Var(&attachments, "attach", "path to a file to attach (repeatable)")
+	fs.Parse(args)
+
+	opts := compose.Options{
+		To:          splitAddresses(*to),
+		Cc:          splitAddresses(*cc),
+		Bcc:         splitAddresses(*bcc),
+		Subject:     *subject,
+		Body:        *body,
+		Attachments: attachments,
+	}
+
+	msg, err := compose.Build(opts)
+	if err != nil {
+		log.Fatalf("Unable to build message: %v", err)
+	}
+
+	if *draft {
+		if _, err := srv.Users.Drafts.Create(user, &gmail.Draft{Message: msg}).Context(ctx).Do(); err != nil {
+			log.Fatalf("Unable to create draft: %v", err)
+		}
+		fmt.Println("Draft saved.")
+		return
+	}
+
+	if _, err := srv.Users.Messages.Send(user, msg).Context(ctx).Do(); err != nil {
+		log.Fatalf("Unable to send message: %v", err)
+	}
+	fmt.Println("Message sent.")
+}
+
+func splitAddresses(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			out = append(out, trimmed)
+		}
+	}
+	return out
+}
+
+// stringSliceFlag collects repeated occurrences of a flag, e.g.
+// -attach a.pdf -attach b.png, into a slice.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// runBackup parses the `backup` subcommand's flags and runs a full or
+// incremental mailbox backup to local mbox/Maildir storage.
+func runBackup(ctx context.Context, srv *gmail.Service, user string, args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	outputDir := fs.String("out", "backup", "directory to write the backup to")
+	format := fs.String("format", "mbox", "output format: mbox or maildir")
+	query := fs.String("q", "", "Gmail search query to filter messages")
+	workers := fs.Int("workers", 4, "number of concurrent message fetches")
+	rateLimit := fs.Float64("rate", 10, "max Gmail API requests per second")
+	var labels stringSliceFlag
+	fs.Var(&labels, "label", "label ID to filter messages by (repeatable)")
+	fs.Parse(args)
+
+	opts := backup.Options{
+		OutputDir: *outputDir,
+		Format:    backup.Format(*format),
+		Query:     *query,
+		LabelIDs:  labels,
+		Workers:   *workers,
+		RateLimit: *rateLimit,
+	}
+
+	if err := backup.Backup(ctx, srv, user, opts); err != nil {
+		log.Fatalf("Backup failed: %v", err)
+	}
 }
 
 func listMessages(srv *gmail.Service, user string) {
@@ -183,37 +528,63 @@ func getMessage(srv *gmail.Service, user string, msgId string) {
 	fmt.Println()
 
 	fmt.Println("Body of message")
-	for _, part := range msg.Payload.Parts {
-
-		if part.MimeType == "text/html" {
-			data, _ := base64.RawURLEncoding.DecodeString(part.Body.Data)
-			html := string(data)
-			fmt.Println(html)
-		}
-	}
-	fmt.Println()
-	fmt.Println()
 	fmt.Println("Attachments:")
-	for _, part := range msg.Payload.Parts {
+	walkParts(msg.Payload, func(part *gmail.MessagePart) {
+		switch {
+		case part.MimeType == "text/plain" || part.MimeType == "text/html":
+			data, _ := base64.RawURLEncoding.DecodeString(part.Body.Data)
+			fmt.Println(string(data))
 
-		if part.MimeType == "application/octet-stream" {
+		case isAttachment(part):
 			fmt.Println("Filename: ", part.Filename)
 			fmt.Println("Id: ", part.Body.AttachmentId)
 			fmt.Println("Attachment size: ", part.Body.Size)
-			err := saveAttachment(srv, user, msg.Id, part.Body.AttachmentId, part.Filename)
+			err := saveAttachment(srv, user, msg.Id, part.Body.AttachmentId, part.Filename, part.MimeType)
 			if err != nil {
-				log.Fatal("Could not save attachment.")
+				fmt.Println("Could not save attachment:", err)
 			} else {
 				fmt.Println("Attachment downloaded")
 			}
-
 		}
-	}
+	})
 
 	fmt.Println("*********************************************")
 
 }
 
+// walkParts recursively descends a message's MIME tree, invoking visit for
+// every leaf (non-multipart) part it finds. Containers (multipart/mixed,
+// multipart/alternative, multipart/related, ...) are descended into rather
+// than visited themselves. Any part with no sub-parts, whatever its MIME
+// type, is visited as a leaf; for a simple (non-multipart) message that is
+// msg.Payload itself, holding msg.Payload.Body directly.
+func walkParts(part *gmail.MessagePart, visit func(*gmail.MessagePart)) {
+	if len(part.Parts) == 0 {
+		visit(part)
+		return
+	}
+	for _, child := range part.Parts {
+		walkParts(child, visit)
+	}
+}
+
+// isAttachment reports whether part should be treated as a downloadable
+// attachment: either it carries a filename, or it declares
+// Content-Disposition: attachment. This catches attachments served under
+// MIME types other than application/octet-stream, such as images or PDFs
+// sent with their real content type.
+func isAttachment(part *gmail.MessagePart) bool {
+	if part.Filename != "" {
+		return true
+	}
+	for _, header := range part.Headers {
+		if header.Name == "Content-Disposition" && strings.HasPrefix(strings.ToLower(header.Value), "attachment") {
+			return true
+		}
+	}
+	return false
+}
+
 func listLabels(labels []string) {
 
 	if len(labels) > 0 {
@@ -226,19 +597,49 @@ func listLabels(labels []string) {
 	}
 }
 
-func saveAttachment(srv *gmail.Service, user, msgId, attachId, filename string) error {
-	attach, _ := srv.Users.Messages.Attachments.Get(user, msgId, attachId).Do()
+// saveAttachment downloads the attachment identified by attachId and writes
+// it to disk under filename. If filename is empty (Content-Disposition:
+// attachment with no declared name), a fallback name is derived from
+// mimeType instead of failing.
+func saveAttachment(srv *gmail.Service, user, msgId, attachId, filename, mimeType string) error {
+	attach, err := srv.Users.Messages.Attachments.Get(user, msgId, attachId).Do()
+	if err != nil {
+		return fmt.Errorf("fetching attachment %s: %w", attachId, err)
+	}
+
 	decoded, err := base64.URLEncoding.DecodeString(attach.Data)
+	if err != nil {
+		return fmt.Errorf("decoding attachment %s: %w", attachId, err)
+	}
+
+	if filename == "" {
+		filename = fallbackAttachmentName(attachId, mimeType)
+	}
 
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Fatalf("Unable to create attachment file: %v", err)
+		return fmt.Errorf("creating attachment file %s: %w", filename, err)
 	}
 	defer f.Close()
 
-	_, err = f.Write(decoded)
-	defer f.Close()
+	if _, err := f.Write(decoded); err != nil {
+		return fmt.Errorf("writing attachment file %s: %w", filename, err)
+	}
 
-	return err
+	return nil
+}
 
+// fallbackAttachmentName derives a filename for an attachment that has no
+// Filename of its own, using the file extension registered for mimeType,
+// if any.
+func fallbackAttachmentName(attachId, mimeType string) string {
+	name := "attachment-" + attachId
+	if mimeType == "" {
+		return name
+	}
+	exts, err := mime.ExtensionsByType(mimeType)
+	if err != nil || len(exts) == 0 {
+		return name
+	}
+	return name + exts[0]
 }
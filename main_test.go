@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestWalkPartsSimpleMessage(t *testing.T) {
+	var visited []*gmail.MessagePart
+	part := &gmail.MessagePart{MimeType: "text/plain"}
+	walkParts(part, func(p *gmail.MessagePart) { visited = append(visited, p) })
+
+	if len(visited) != 1 || visited[0] != part {
+		t.Fatalf("walkParts on a non-multipart message visited %v, want [part]", visited)
+	}
+}
+
+func TestWalkPartsNestedMultipart(t *testing.T) {
+	text := &gmail.MessagePart{MimeType: "text/plain"}
+	html := &gmail.MessagePart{MimeType: "text/html"}
+	attachment := &gmail.MessagePart{MimeType: "application/pdf", Filename: "report.pdf"}
+
+	alt := &gmail.MessagePart{MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{text, html}}
+	root := &gmail.MessagePart{MimeType: "multipart/mixed", Parts: []*gmail.MessagePart{alt, attachment}}
+
+	var visited []*gmail.MessagePart
+	walkParts(root, func(p *gmail.MessagePart) { visited = append(visited, p) })
+
+	want := []*gmail.MessagePart{text, html, attachment}
+	if len(visited) != len(want) {
+		t.Fatalf("walkParts visited %d leaves, want %d", len(visited), len(want))
+	}
+	for i, p := range want {
+		if visited[i] != p {
+			t.Errorf("visited[%d] = %v, want %v", i, visited[i], p)
+		}
+	}
+}
+
+func TestIsAttachment(t *testing.T) {
+	cases := []struct {
+		name string
+		part *gmail.MessagePart
+		want bool
+	}{
+		{
+			name: "plain text body",
+			part: &gmail.MessagePart{MimeType: "text/plain"},
+			want: false,
+		},
+		{
+			name: "has a filename",
+			part: &gmail.MessagePart{MimeType: "application/pdf", Filename: "report.pdf"},
+			want: true,
+		},
+		{
+			name: "Content-Disposition: attachment with no filename",
+			part: &gmail.MessagePart{
+				MimeType: "image/png",
+				Headers: []*gmail.MessagePartHeader{
+					{Name: "Content-Disposition", Value: "attachment"},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "Content-Disposition: inline",
+			part: &gmail.MessagePart{
+				MimeType: "image/png",
+				Headers: []*gmail.MessagePartHeader{
+					{Name: "Content-Disposition", Value: "inline"},
+				},
+			},
+			want: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isAttachment(c.part); got != c.want {
+				t.Errorf("isAttachment() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package tokenstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	scryptSaltLen = 16
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeyLen  = 32
+)
+
+// EncryptedFileStore persists each account's token as an AES-GCM
+// encrypted file under Dir, named after the account. The encryption key
+// is derived from Passphrase via scrypt, with a fresh random salt per
+// file so the same passphrase never reuses a key across accounts.
+type EncryptedFileStore struct {
+	Dir        string
+	Passphrase string
+}
+
+// NewEncryptedFileStore returns an EncryptedFileStore rooted at dir,
+// creating it if needed.
+func NewEncryptedFileStore(dir, passphrase string) (*EncryptedFileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &EncryptedFileStore{Dir: dir, Passphrase: passphrase}, nil
+}
+
+func (s *EncryptedFileStore) path(account string) string {
+	return filepath.Join(s.Dir, url.QueryEscape(account)+".enc")
+}
+
+// Get decrypts and decodes the Token stored for account.
+func (s *EncryptedFileStore) Get(account string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(s.path(account))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no token cached for %s: %w", account, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting token for %s: %w", account, err)
+	}
+
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(plaintext, tok); err != nil {
+		return nil, fmt.Errorf("decoding token for %s: %w", account, err)
+	}
+	return tok, nil
+}
+
+// Put encrypts and writes token for account.
+func (s *EncryptedFileStore) Put(account string, tok *oauth2.Token) error {
+	plaintext, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("encoding token for %s: %w", account, err)
+	}
+
+	ciphertext, err := s.encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("encrypting token for %s: %w", account, err)
+	}
+
+	return ioutil.WriteFile(s.path(account), ciphertext, 0600)
+}
+
+// encrypt returns salt || nonce || AES-GCM ciphertext, so decrypt can
+// re-derive the key and open the box from the file alone.
+func (s *EncryptedFileStore) encrypt(plaintext []byte) ([]byte, error) {
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := s.gcmForSalt(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nil, nonce, plaintext, nil)
+	return append(append(salt, nonce...), sealed...), nil
+}
+
+func (s *EncryptedFileStore) decrypt(data []byte) ([]byte, error) {
+	if len(data) < scryptSaltLen {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	salt, rest := data[:scryptSaltLen], data[scryptSaltLen:]
+
+	gcm, err := s.gcmForSalt(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func (s *EncryptedFileStore) gcmForSalt(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(s.Passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,64 @@
+package tokenstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptedFileStoreRoundTrip(t *testing.T) {
+	s := &EncryptedFileStore{Passphrase: "correct horse battery staple"}
+	plaintext := []byte(`{"access_token":"secret"}`)
+
+	ciphertext, err := s.encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatalf("ciphertext contains the plaintext verbatim")
+	}
+
+	got, err := s.decrypt(ciphertext)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypt returned %q, want %q", got, plaintext)
+	}
+}
+
+func TestEncryptedFileStoreWrongPassphrase(t *testing.T) {
+	s := &EncryptedFileStore{Passphrase: "right passphrase"}
+	ciphertext, err := s.encrypt([]byte("top secret"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	wrong := &EncryptedFileStore{Passphrase: "wrong passphrase"}
+	if _, err := wrong.decrypt(ciphertext); err == nil {
+		t.Fatal("decrypt with wrong passphrase succeeded, want error")
+	}
+}
+
+func TestEncryptedFileStoreCorruptedCiphertext(t *testing.T) {
+	s := &EncryptedFileStore{Passphrase: "a passphrase"}
+	ciphertext, err := s.encrypt([]byte("top secret"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := s.decrypt(tampered); err == nil {
+		t.Fatal("decrypt of tampered ciphertext succeeded, want error")
+	}
+
+	for _, n := range []int{0, 1, scryptSaltLen, scryptSaltLen + 1} {
+		if n > len(ciphertext) {
+			n = len(ciphertext)
+		}
+		truncated := ciphertext[:n]
+		if _, err := s.decrypt(truncated); err == nil {
+			t.Fatalf("decrypt of %d-byte truncated ciphertext succeeded, want error", len(truncated))
+		}
+	}
+}
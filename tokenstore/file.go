@@ -0,0 +1,61 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+// FileStore persists each account's token as plaintext JSON in its own
+// file under Dir, named after the account. This is the original
+// ~/.credentials/gmail-go-quickstart.json layout, generalized to one file
+// per account instead of a single hardcoded path.
+type FileStore struct {
+	Dir string
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (s *FileStore) path(account string) string {
+	return filepath.Join(s.Dir, url.QueryEscape(account)+".json")
+}
+
+// Get retrieves a Token from the file path. It returns the retrieved
+// Token and any read error encountered.
+func (s *FileStore) Get(account string) (*oauth2.Token, error) {
+	f, err := os.Open(s.path(account))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no token cached for %s: %w", account, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tok := &oauth2.Token{}
+	if err := json.NewDecoder(f).Decode(tok); err != nil {
+		return nil, fmt.Errorf("decoding token for %s: %w", account, err)
+	}
+	return tok, nil
+}
+
+// Put writes token to account's file path.
+func (s *FileStore) Put(account string, tok *oauth2.Token) error {
+	f, err := os.OpenFile(s.path(account), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("caching token for %s: %w", account, err)
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(tok)
+}
@@ -0,0 +1,53 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+)
+
+// KeyringStore persists each account's token in the OS-provided secret
+// store (macOS Keychain, GNOME Keyring/Secret Service, Windows Credential
+// Manager), avoiding an on-disk token file entirely.
+type KeyringStore struct {
+	// Service namespaces entries in the OS keyring, so this app's tokens
+	// don't collide with unrelated entries under the same account name.
+	Service string
+}
+
+// NewKeyringStore returns a KeyringStore under the given service name.
+func NewKeyringStore(service string) *KeyringStore {
+	return &KeyringStore{Service: service}
+}
+
+// Get retrieves and decodes the Token stored for account.
+func (s *KeyringStore) Get(account string) (*oauth2.Token, error) {
+	data, err := keyring.Get(s.Service, account)
+	if err == keyring.ErrNotFound {
+		return nil, fmt.Errorf("no token cached for %s: %w", account, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading token for %s from keyring: %w", account, err)
+	}
+
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal([]byte(data), tok); err != nil {
+		return nil, fmt.Errorf("decoding token for %s: %w", account, err)
+	}
+	return tok, nil
+}
+
+// Put encodes and writes token for account.
+func (s *KeyringStore) Put(account string, tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("encoding token for %s: %w", account, err)
+	}
+	if err := keyring.Set(s.Service, account, string(data)); err != nil {
+		return fmt.Errorf("writing token for %s to keyring: %w", account, err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// Package tokenstore abstracts where OAuth2 tokens are persisted between
+// runs, so a single binary can back up multiple Gmail accounts and choose
+// how (or whether) tokens are protected at rest.
+package tokenstore
+
+import "golang.org/x/oauth2"
+
+// Store persists OAuth2 tokens keyed by account (the Gmail address the
+// token belongs to), so callers can manage credentials for more than one
+// account from one binary.
+//
+// Get returns an error wrapping fs.ErrNotExist (via %w, checkable with
+// errors.Is) when no token has been stored for account yet.
+type Store interface {
+	Get(account string) (*oauth2.Token, error)
+	Put(account string, tok *oauth2.Token) error
+}
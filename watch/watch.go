@@ -0,0 +1,253 @@
+// Package watch keeps a mailbox in sync via Gmail's push notifications:
+// it registers a Cloud Pub/Sub watch with Users.Watch, then turns each
+// notification into a Users.History.List delta, dispatched to the
+// caller as typed events rather than requiring the caller to poll.
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+)
+
+// watchLifetime is how long a Users.Watch registration is renewed for
+// before its actual ~7-day expiration, to leave margin for the renewal
+// call itself and any delay in processing it.
+const watchLifetime = 6*24*time.Hour + 12*time.Hour
+
+// Notification is what the caller's Pub/Sub subscriber delivers each time
+// Gmail pushes a change notification for the watched mailbox.
+type Notification struct {
+	EmailAddress string
+	HistoryID    uint64
+}
+
+// NotificationSource decouples this package from any particular Pub/Sub
+// client library: the caller wires up a Cloud Pub/Sub subscription (e.g.
+// with cloud.google.com/go/pubsub) and adapts its messages into this
+// channel.
+type NotificationSource interface {
+	Notifications() <-chan Notification
+}
+
+// EventHandler receives the typed mailbox changes found in each history
+// delta. Implementations should return quickly; Sync delivers events
+// synchronously and won't process the next batch until the handler
+// returns.
+type EventHandler interface {
+	MessageAdded(messageID, threadID string)
+	MessageDeleted(messageID string)
+	LabelsAdded(messageID string, labelIDs []string)
+	LabelsRemoved(messageID string, labelIDs []string)
+
+	// ResyncRequired is called when st.HistoryID has aged out of Gmail's
+	// ~7-day retention window and History.List can no longer enumerate
+	// what changed since the last-seen historyId. Any Message*/Labels*
+	// changes within that gap are not replayed as individual events; the
+	// handler is expected to reconcile by other means (e.g. the backup
+	// subsystem re-running a full Users.Messages.List) before relying on
+	// incremental events again.
+	ResyncRequired()
+}
+
+// Options configures a Watcher.
+type Options struct {
+	// Topic is the Cloud Pub/Sub topic Gmail publishes notifications to,
+	// e.g. "projects/my-project/topics/gmail-push".
+	Topic string
+	// LabelIDs restricts notifications to these labels. A nil slice
+	// watches the whole mailbox.
+	LabelIDs []string
+	// StateFile persists the last-seen historyId and the current watch's
+	// expiration. Defaults to "watch-state.json".
+	StateFile string
+}
+
+type watchState struct {
+	HistoryID uint64    `json:"historyId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Watcher drives the watch-and-sync loop for a single mailbox.
+type Watcher struct {
+	srv     *gmail.Service
+	user    string
+	opts    Options
+	handler EventHandler
+}
+
+// New returns a Watcher that notifies handler of changes to user's
+// mailbox ("me" for the authenticated user).
+func New(srv *gmail.Service, user string, opts Options, handler EventHandler) *Watcher {
+	if opts.StateFile == "" {
+		opts.StateFile = "watch-state.json"
+	}
+	return &Watcher{srv: srv, user: user, opts: opts, handler: handler}
+}
+
+// Sync registers (or renews) the Pub/Sub watch and then blocks, consuming
+// notifications from src and translating each into a History.List delta,
+// until ctx is canceled. It re-issues the watch on its own once
+// watchLifetime has elapsed, ahead of the watch's ~7-day expiration, and
+// falls back to a full re-baseline via GetProfile if, when a notification
+// arrives, the last-seen historyId has already aged out of Gmail's
+// retention window.
+func (w *Watcher) Sync(ctx context.Context, src NotificationSource) error {
+	st, err := loadWatchState(w.opts.StateFile)
+	if err != nil {
+		return fmt.Errorf("loading watch state: %w", err)
+	}
+	if st.HistoryID == 0 || time.Now().After(st.ExpiresAt) {
+		if st, err = w.renew(ctx); err != nil {
+			return err
+		}
+	}
+
+	notifications := src.Notifications()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case n, ok := <-notifications:
+			if !ok {
+				return nil
+			}
+			if err := w.processNotification(ctx, &st, n); err != nil {
+				return err
+			}
+
+		case <-time.After(time.Until(st.ExpiresAt)):
+			if st, err = w.renew(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// renew (re-)registers the Pub/Sub watch, refreshes state.ExpiresAt, and
+// persists the result.
+func (w *Watcher) renew(ctx context.Context) (watchState, error) {
+	req := &gmail.WatchRequest{TopicName: w.opts.Topic}
+	if len(w.opts.LabelIDs) > 0 {
+		req.LabelIds = w.opts.LabelIDs
+	}
+	resp, err := w.srv.Users.Watch(w.user, req).Context(ctx).Do()
+	if err != nil {
+		return watchState{}, fmt.Errorf("registering watch: %w", err)
+	}
+
+	st, err := loadWatchState(w.opts.StateFile)
+	if err != nil {
+		return watchState{}, fmt.Errorf("loading watch state: %w", err)
+	}
+	if st.HistoryID == 0 {
+		st.HistoryID = resp.HistoryId
+	}
+	st.ExpiresAt = time.Now().Add(watchLifetime)
+	if err := saveWatchState(w.opts.StateFile, st); err != nil {
+		return watchState{}, fmt.Errorf("saving watch state: %w", err)
+	}
+	return st, nil
+}
+
+// processNotification pages through the history delta since st.HistoryID,
+// dispatching each entry's events to w.handler, then advances and
+// persists st.HistoryID.
+func (w *Watcher) processNotification(ctx context.Context, st *watchState, n Notification) error {
+	pageToken := ""
+	for {
+		call := w.srv.Users.History.List(w.user).StartHistoryId(st.HistoryID).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Do()
+		if err != nil {
+			if isHistoryExpired(err) {
+				return w.fullResync(ctx, st)
+			}
+			return fmt.Errorf("listing history: %w", err)
+		}
+
+		for _, h := range resp.History {
+			w.dispatch(h)
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	st.HistoryID = n.HistoryID
+	return saveWatchState(w.opts.StateFile, *st)
+}
+
+func (w *Watcher) dispatch(h *gmail.History) {
+	for _, a := range h.MessagesAdded {
+		w.handler.MessageAdded(a.Message.Id, a.Message.ThreadId)
+	}
+	for _, d := range h.MessagesDeleted {
+		w.handler.MessageDeleted(d.Message.Id)
+	}
+	for _, l := range h.LabelsAdded {
+		w.handler.LabelsAdded(l.Message.Id, l.LabelIds)
+	}
+	for _, l := range h.LabelsRemoved {
+		w.handler.LabelsRemoved(l.Message.Id, l.LabelIds)
+	}
+}
+
+// fullResync handles Gmail's ~7-day history retention: once st.HistoryID
+// has aged out, History.List returns 404 for every subsequent call until
+// we re-baseline. Rather than trying to enumerate a gap Gmail no longer
+// has records for, it jumps straight to the mailbox's current historyId
+// and calls w.handler.ResyncRequired so the caller can reconcile the
+// missed window itself (e.g. by re-running a full backup listing) before
+// incremental events resume.
+func (w *Watcher) fullResync(ctx context.Context, st *watchState) error {
+	profile, err := w.srv.Users.GetProfile(w.user).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("refreshing profile after history expiry: %w", err)
+	}
+	st.HistoryID = profile.HistoryId
+	if err := saveWatchState(w.opts.StateFile, *st); err != nil {
+		return err
+	}
+	w.handler.ResyncRequired()
+	return nil
+}
+
+func isHistoryExpired(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404")
+}
+
+func loadWatchState(path string) (watchState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return watchState{}, nil
+	}
+	if err != nil {
+		return watchState{}, err
+	}
+	var st watchState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return watchState{}, err
+	}
+	return st, nil
+}
+
+func saveWatchState(path string, st watchState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
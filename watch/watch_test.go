@@ -0,0 +1,86 @@
+package watch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+func TestIsHistoryExpired(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil error", nil, false},
+		{"404 from Gmail", errors.New(`googleapi: Error 404: Requested entity was not found.`), true},
+		{"other error", errors.New(`googleapi: Error 500: Internal error.`), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isHistoryExpired(c.err); got != c.want {
+				t.Errorf("isHistoryExpired(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+// resyncRecorder is a minimal EventHandler that only tracks whether
+// ResyncRequired was called, which is all fullResync's own logic needs.
+type resyncRecorder struct {
+	resyncCalled bool
+}
+
+func (r *resyncRecorder) MessageAdded(string, string)    {}
+func (r *resyncRecorder) MessageDeleted(string)          {}
+func (r *resyncRecorder) LabelsAdded(string, []string)   {}
+func (r *resyncRecorder) LabelsRemoved(string, []string) {}
+func (r *resyncRecorder) ResyncRequired()                { r.resyncCalled = true }
+
+func TestFullResync(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"historyId": "999"}`))
+	}))
+	defer srv.Close()
+
+	gmailSvc, err := gmail.NewService(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("gmail.NewService: %v", err)
+	}
+	gmailSvc.BasePath = srv.URL
+
+	handler := &resyncRecorder{}
+	w := &Watcher{
+		srv:     gmailSvc,
+		user:    "me",
+		opts:    Options{StateFile: filepath.Join(t.TempDir(), "watch-state.json")},
+		handler: handler,
+	}
+
+	st := &watchState{HistoryID: 100}
+	if err := w.fullResync(context.Background(), st); err != nil {
+		t.Fatalf("fullResync: %v", err)
+	}
+
+	if st.HistoryID != 999 {
+		t.Errorf("st.HistoryID = %d, want 999", st.HistoryID)
+	}
+	if !handler.resyncCalled {
+		t.Error("fullResync did not call handler.ResyncRequired")
+	}
+
+	saved, err := loadWatchState(w.opts.StateFile)
+	if err != nil {
+		t.Fatalf("loadWatchState: %v", err)
+	}
+	if saved.HistoryID != 999 {
+		t.Errorf("persisted HistoryID = %d, want 999", saved.HistoryID)
+	}
+}